@@ -1,24 +1,39 @@
 package duplex
 
 import (
-//"io"
+	"net"
+	//"io"
 )
 
 type Channel interface {
 	Write(data []byte) (int, error) // send
 	Read(data []byte) (int, error)  // recv
 
-	WriteFrame(data []byte) error // send_frame
-	ReadFrame() ([]byte, error)   // recv_frame
+	// WriteFrame/ReadFrame are length-prefixed; framed and raw Read/Write
+	// must not be mixed on the same channel. ReadFrameInto reads into a
+	// caller-supplied buffer to avoid ReadFrame's per-call allocation.
+	WriteFrame(data []byte) error           // send_frame
+	ReadFrame() ([]byte, error)             // recv_frame
+	ReadFrameInto(buf []byte) (int, error)  // recv_frame, zero-alloc
 
 	WriteError(data []byte) error // send_error
 	ReadError() ([]byte, error)   // recv_error
 
+	// WriteTrailers sends trailing metadata just before CloseWrite; Trailers
+	// blocks until what the peer sent is readable, which is guaranteed by
+	// the time this end has seen EOF. If the peer sent no trailers, Trailers
+	// blocks until the channel's request stream ends and then returns nil.
+	WriteTrailers(trailers map[string]string) error
+	Trailers() map[string]string
+
 	CloseWrite() error // send_end .. close_send?
 	Close() error      // close
 
-	//Open(chType, service string, headers []string) (Channel, error) // send_chan
-	//Accept(chType string) (ChannelMeta, Channel)                    // recv_chan
+	// Open and Accept attach a sub-channel to this one, for structured
+	// multi-stream use (e.g. splitting stdout/stderr, or sending a file
+	// alongside a call) without opening a second top-level connection.
+	Open(service string, headers []string) (Channel, error) // send_chan
+	Accept() (Channel, error)                               // recv_chan
 
 	//Join(rwc io.ReadWriteCloser) // join(fd)
 }
@@ -33,6 +48,15 @@ type peerConnection interface {
 	Name() string
 	Endpoint() string
 	Open(service string, headers []string) (Channel, error)
+
+	// ListenRemote asks the peer to listen on network/addr (e.g. "unix",
+	// "/var/run/foo.sock" or "tcp", "127.0.0.1:8080") and forward each
+	// accepted connection back over duplex as a net.Conn on the returned
+	// Listener.
+	ListenRemote(network, addr string) (net.Listener, error)
+	// DialRemote asks the peer to dial network/addr and bridges the
+	// resulting connection over duplex as the returned net.Conn.
+	DialRemote(network, addr string) (net.Conn, error)
 }
 
 type peerListener interface {
@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/user"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/progrium/crypto/ssh"
+	"github.com/progrium/crypto/ssh/agent"
+	"github.com/progrium/crypto/ssh/knownhosts"
 )
 
 // ssh keys
@@ -28,6 +35,129 @@ func loadPrivateKey(path string) (ssh.Signer, error) {
 	return ssh.ParsePrivateKey(pem)
 }
 
+// HostKey returns the peer's own SSH host public key, as loaded from
+// OptPrivateKey, so operators can pin or publish it out-of-band.
+func (p *Peer) HostKey() (ssh.PublicKey, error) {
+	pk, err := loadPrivateKey(p.GetOption(OptPrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return pk.PublicKey(), nil
+}
+
+// hostKeyCallback builds the client's HostKeyCallback from OptKnownHosts. If
+// unset, all host keys are accepted (matching prior behaviour). On an
+// unknown (but not conflicting) host key it defers to peer.HostKeyPrompt, if
+// the application set one, instead of failing closed or open unconditionally.
+func hostKeyCallback(peer *Peer, addr string) (ssh.HostKeyCallback, error) {
+	path := peer.GetOption(OptKnownHosts)
+	if path == "" {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	known, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok || len(keyErr.Want) != 0 {
+			return err // either unrelated error or a changed/conflicting key
+		}
+		if peer.HostKeyPrompt == nil {
+			return err
+		}
+		return peer.HostKeyPrompt(addr, key)
+	}, nil
+}
+
+// agentSocket resolves the ssh-agent socket to dial: the explicit option if
+// set, falling back to $SSH_AUTH_SOCK, as most ssh-agent-aware tools do.
+func agentSocket(peer *Peer) string {
+	if sock := peer.GetOption(OptAgentSocket); sock != "" {
+		return sock
+	}
+	return os.Getenv("SSH_AUTH_SOCK")
+}
+
+// agentSigners dials sock and returns a Signers func bound to that
+// connection, plus the connection itself so the caller can close it once
+// the handshake is done with it.
+func agentSigners(sock string) (func() ([]ssh.Signer, error), net.Conn, error) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, err
+	}
+	return agent.NewClient(conn).Signers, conn, nil
+}
+
+// loadCertificate reads an SSH certificate (as produced by `ssh-keygen -s`)
+// from path, for use with ssh.NewCertSigner.
+func loadCertificate(path string) (*ssh.Certificate, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not a certificate")
+	}
+	return cert, nil
+}
+
+// loadAuthorizedKey reads a single public key in authorized_keys format,
+// such as a TrustedUserCAKeys file.
+func loadAuthorizedKey(path string) (ssh.PublicKey, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(raw)
+	return key, err
+}
+
+// clientAuthMethod picks the peer's configured client auth method, in order
+// of preference: a CA-issued certificate, an ssh-agent, or a private key
+// loaded from disk. The returned closer, if non-nil, must be closed once the
+// handshake that consumes the auth method has completed (e.g. right after
+// ssh.NewClientConn returns) to avoid leaking the agent socket connection.
+func clientAuthMethod(peer *Peer) (ssh.AuthMethod, io.Closer, error) {
+	if certPath := peer.GetOption(OptCertificate); certPath != "" {
+		pk, err := loadPrivateKey(peer.GetOption(OptPrivateKey))
+		if err != nil {
+			return nil, nil, err
+		}
+		cert, err := loadCertificate(certPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		certSigner, err := ssh.NewCertSigner(cert, pk)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ssh.PublicKeys(certSigner), nil, nil
+	}
+	if sock := agentSocket(peer); sock != "" {
+		signers, conn, err := agentSigners(sock)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ssh.PublicKeysCallback(signers), conn, nil
+	}
+	pk, err := loadPrivateKey(peer.GetOption(OptPrivateKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	return ssh.PublicKeys(pk), nil, nil
+}
+
 // ssh structs
 
 type ssh_greetingPayload struct {
@@ -37,6 +167,85 @@ type ssh_greetingPayload struct {
 type ssh_channelData struct {
 	Service string
 	Headers []string
+
+	// ID identifies this channel to its opener, so that a later channel can
+	// reference it as a parent via Attach/FlagAttached.
+	ID           uint64
+	Attach       uint64
+	FlagAttached bool
+}
+
+// ssh_trailerPayload is the "trailers" channel request body. Maps can't be
+// ssh.Marshal'd directly, so keys/values travel as parallel slices, the same
+// way ssh_channelData carries Headers.
+type ssh_trailerPayload struct {
+	Keys   []string
+	Values []string
+}
+
+// ssh_forwardPayload accompanies both the "forward-listen@duplex" /
+// "forward-unlisten@duplex" global requests and "@duplex-forward" channels.
+type ssh_forwardPayload struct {
+	Network string
+	Addr    string
+}
+
+func forwardKey(network, addr string) string {
+	return network + ":" + addr
+}
+
+// forwardAllowed authorizes a forwarding request from a peer: listen is true
+// for "forward-listen@duplex" (the peer wants us to bind network/addr and
+// relay back whatever connects) and false for a direct "@duplex-forward"
+// dial (the peer wants us to dial network/addr locally). Without
+// peer.ForwardPolicy set, every such request is rejected: failing open here
+// would let any authenticated peer make this process bind an arbitrary port
+// or dial an arbitrary address (SSRF).
+func forwardAllowed(peer *Peer, network, addr string, listen bool) error {
+	if peer.ForwardPolicy == nil {
+		return errors.New("duplex: forwarding is disabled (no ForwardPolicy configured)")
+	}
+	return peer.ForwardPolicy(network, addr, listen)
+}
+
+// removeStaleUnixSocket reports whether OptForwardRemoveStaleSocket has been
+// set, opting in to unlinking a unix socket path before listening on it.
+func removeStaleUnixSocket(peer *Peer) bool {
+	ok, _ := strconv.ParseBool(peer.GetOption(OptForwardRemoveStaleSocket))
+	return ok
+}
+
+// addrString is a net.Addr for forwarded connections, which have no real
+// local/remote socket address on this side of the duplex link.
+type addrString struct {
+	network string
+	addr    string
+}
+
+func (a addrString) Network() string { return a.network }
+func (a addrString) String() string  { return a.addr }
+
+// ssh_forwardConn adapts a raw @duplex-forward ssh.Channel to net.Conn.
+type ssh_forwardConn struct {
+	ssh.Channel
+	laddr, raddr net.Addr
+}
+
+func (c *ssh_forwardConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *ssh_forwardConn) RemoteAddr() net.Addr { return c.raddr }
+
+var errForwardDeadline = errors.New("duplex: forwarded connections don't support deadlines")
+
+func (c *ssh_forwardConn) SetDeadline(t time.Time) error      { return errForwardDeadline }
+func (c *ssh_forwardConn) SetReadDeadline(t time.Time) error  { return errForwardDeadline }
+func (c *ssh_forwardConn) SetWriteDeadline(t time.Time) error { return errForwardDeadline }
+
+// bridge copies in both directions until either side is done.
+func bridge(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(a, b); done <- struct{}{} }()
+	go func() { io.Copy(b, a); done <- struct{}{} }()
+	<-done
 }
 
 // ssh listener
@@ -55,6 +264,217 @@ type ssh_peerConnection struct {
 	addr string
 	name string
 	conn ssh.Conn
+	peer *Peer
+
+	// initiator is true on the side that dialed (vs. accepted) this
+	// connection. Channel IDs are assigned independently by each side's own
+	// nextID counter, so initiator picks disjoint (odd vs. even) numbering
+	// via channelID to keep the two sides' IDs from colliding in the shared
+	// attachedCh keyspace.
+	initiator bool
+
+	mu         sync.Mutex
+	nextID     uint64
+	attachedCh map[uint64]chan Channel
+
+	// forwardListeners holds the accept queues for our own ListenRemote
+	// calls, keyed by forwardKey(network, addr).
+	forwardListeners map[string]*ssh_forwardAccept
+	// remoteListeners holds the local net.Listeners we opened because the
+	// peer asked us to via "forward-listen@duplex", keyed the same way.
+	remoteListeners map[string]net.Listener
+}
+
+// channelID maps this side's local monotonic counter n to a wire channel
+// ID: odd for the initiating side, even for the accepting side.
+func (c *ssh_peerConnection) channelID(n uint64) uint64 {
+	if c.initiator {
+		return 2*n - 1
+	}
+	return 2 * n
+}
+
+// attachedChan returns (creating if needed) the channel that sub-channels
+// attached to parent are delivered on, for Channel.Accept to read from.
+func (c *ssh_peerConnection) attachedChan(parent uint64) chan Channel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.attachedCh == nil {
+		c.attachedCh = make(map[uint64]chan Channel)
+	}
+	ch, ok := c.attachedCh[parent]
+	if !ok {
+		ch = make(chan Channel)
+		c.attachedCh[parent] = ch
+	}
+	return ch
+}
+
+func (c *ssh_peerConnection) ListenRemote(network, addr string) (net.Listener, error) {
+	ok, _, err := c.conn.SendRequest("forward-listen@duplex", true, ssh.Marshal(&ssh_forwardPayload{network, addr}))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("peer refused to listen")
+	}
+	accept := &ssh_forwardAccept{conns: make(chan net.Conn), closed: make(chan struct{})}
+	c.mu.Lock()
+	if c.forwardListeners == nil {
+		c.forwardListeners = make(map[string]*ssh_forwardAccept)
+	}
+	c.forwardListeners[forwardKey(network, addr)] = accept
+	c.mu.Unlock()
+	return &ssh_forwardListener{conn: c, network: network, addr: addr, accept: accept}, nil
+}
+
+// ssh_forwardAccept is the accept queue registered in forwardListeners for a
+// ListenRemote call. closed is closed by ssh_forwardListener.Close (or
+// connection teardown) so a connection delivered mid-teardown can be
+// selected away instead of racing a send against, or blocking forever on, an
+// Accept that will never come.
+type ssh_forwardAccept struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (a *ssh_forwardAccept) close() {
+	a.closeOnce.Do(func() { close(a.closed) })
+}
+
+func (c *ssh_peerConnection) DialRemote(network, addr string) (net.Conn, error) {
+	ch, reqs, err := c.conn.OpenChannel("@duplex-forward", ssh.Marshal(&ssh_forwardPayload{network, addr}))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return &ssh_forwardConn{Channel: ch, raddr: addrString{network, addr}}, nil
+}
+
+// ssh_forwardListener is the net.Listener returned by ListenRemote; Accept
+// yields a net.Conn per @duplex-forward channel the peer opens back to us.
+type ssh_forwardListener struct {
+	conn    *ssh_peerConnection
+	network string
+	addr    string
+	accept  *ssh_forwardAccept
+}
+
+func (l *ssh_forwardListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept.conns:
+		return conn, nil
+	case <-l.accept.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *ssh_forwardListener) Close() error {
+	l.conn.mu.Lock()
+	delete(l.conn.forwardListeners, forwardKey(l.network, l.addr))
+	l.conn.mu.Unlock()
+	l.accept.close()
+	_, _, err := l.conn.conn.SendRequest("forward-unlisten@duplex", true, ssh.Marshal(&ssh_forwardPayload{l.network, l.addr}))
+	return err
+}
+
+func (l *ssh_forwardListener) Addr() net.Addr {
+	return addrString{l.network, l.addr}
+}
+
+// ssh_serveForward accepts connections on a listener opened on the peer's
+// behalf (in response to "forward-listen@duplex") and hands each one back
+// over duplex as a new @duplex-forward channel.
+func ssh_serveForward(listener net.Listener, peerConn *ssh_peerConnection, payload ssh_forwardPayload) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			ch, reqs, err := peerConn.conn.OpenChannel("@duplex-forward", ssh.Marshal(&payload))
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			defer ch.Close()
+			bridge(ch, conn)
+		}()
+	}
+}
+
+// ssh_handleGlobalRequest services connection-level (non-channel) requests
+// common to both the client and server side of a duplex connection: our own
+// "keepalive@duplex" pings, forwarding setup, and a default case that
+// refuses anything else (including other keepalives), matching OpenSSH.
+func ssh_handleGlobalRequest(req *ssh.Request, peerConn *ssh_peerConnection) {
+	switch req.Type {
+	case "keepalive@duplex":
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+	case "forward-listen@duplex":
+		var payload ssh_forwardPayload
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			return
+		}
+		if err := forwardAllowed(peerConn.peer, payload.Network, payload.Addr, true); err != nil {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			return
+		}
+		// Removing a stale unix socket is only safe when the operator has
+		// opted in: payload.Addr is chosen by the peer, so unconditionally
+		// unlinking it would let any authenticated peer delete an arbitrary
+		// file this process can reach.
+		if payload.Network == "unix" && removeStaleUnixSocket(peerConn.peer) {
+			os.Remove(payload.Addr)
+		}
+		listener, err := net.Listen(payload.Network, payload.Addr)
+		if err != nil {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			return
+		}
+		peerConn.mu.Lock()
+		if peerConn.remoteListeners == nil {
+			peerConn.remoteListeners = make(map[string]net.Listener)
+		}
+		peerConn.remoteListeners[forwardKey(payload.Network, payload.Addr)] = listener
+		peerConn.mu.Unlock()
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+		go ssh_serveForward(listener, peerConn, payload)
+	case "forward-unlisten@duplex":
+		var payload ssh_forwardPayload
+		if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
+			key := forwardKey(payload.Network, payload.Addr)
+			peerConn.mu.Lock()
+			listener, ok := peerConn.remoteListeners[key]
+			delete(peerConn.remoteListeners, key)
+			peerConn.mu.Unlock()
+			if ok {
+				listener.Close()
+			}
+		}
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+	default:
+		// This handles keepalive messages and matches the behaviour of
+		// OpenSSH.
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
 }
 
 func (c *ssh_peerConnection) Disconnect() error {
@@ -70,16 +490,31 @@ func (c *ssh_peerConnection) Addr() string {
 }
 
 func (c *ssh_peerConnection) Open(service string, headers []string) (Channel, error) {
+	return c.open(0, service, headers)
+}
+
+// open creates a new @duplex channel, optionally attached to parent (the ID
+// of a channel on this connection, as assigned by whichever side opened it;
+// 0 means no parent).
+func (c *ssh_peerConnection) open(parent uint64, service string, headers []string) (*ssh_channel, error) {
+	c.mu.Lock()
+	c.nextID++
+	id := c.channelID(c.nextID)
+	c.mu.Unlock()
+
 	meta := ssh_channelData{
-		Service: service,
-		Headers: headers,
+		Service:      service,
+		Headers:      headers,
+		ID:           id,
+		Attach:       parent,
+		FlagAttached: parent != 0,
 	}
 	ch, reqs, err := c.conn.OpenChannel("@duplex", ssh.Marshal(meta))
 	if err != nil {
 		return nil, err
 	}
-	go ssh.DiscardRequests(reqs)
-	return &ssh_channel{ch, meta}, nil
+	sc := newSSHChannel(ch, reqs, meta, c, maxFrameSize(c.peer))
+	return sc, nil
 }
 
 // ssh server
@@ -89,13 +524,57 @@ func newPeerListener_ssh(peer *Peer, typ, addr string) (peerListener, error) {
 	if err != nil {
 		return nil, err
 	}
-	config := &ssh.ServerConfig{
-		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			if bytes.Equal(key.Marshal(), pk.PublicKey().Marshal()) {
-				return &ssh.Permissions{}, nil
+
+	authorizedKey := pk.PublicKey().Marshal()
+	// Unlike the client, the server only honours an explicitly configured
+	// agent socket: falling back to $SSH_AUTH_SOCK here would let whatever
+	// agent happens to be in the server's environment silently replace the
+	// configured host-key authorization.
+	agentSock := peer.GetOption(OptAgentSocket)
+	agentIdentity := peer.GetOption(OptAgentIdentity)
+
+	publicKeyCallback := func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if agentSock != "" {
+			agentConn, err := net.Dial("unix", agentSock)
+			if err != nil {
+				return nil, err
+			}
+			defer agentConn.Close()
+			keys, err := agent.NewClient(agentConn).List()
+			if err != nil {
+				return nil, err
+			}
+			for _, k := range keys {
+				if agentIdentity != "" && k.Comment != agentIdentity {
+					continue
+				}
+				if bytes.Equal(key.Marshal(), k.Marshal()) {
+					return &ssh.Permissions{}, nil
+				}
 			}
 			return nil, errors.New("unauthorized")
-		},
+		}
+		if bytes.Equal(key.Marshal(), authorizedKey) {
+			return &ssh.Permissions{}, nil
+		}
+		return nil, errors.New("unauthorized")
+	}
+
+	if caPath := peer.GetOption(OptTrustedCA); caPath != "" {
+		caKey, err := loadAuthorizedKey(caPath)
+		if err != nil {
+			return nil, err
+		}
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return bytes.Equal(auth.Marshal(), caKey.Marshal())
+			},
+		}
+		publicKeyCallback = checker.Authenticate
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: publicKeyCallback,
 	}
 	config.AddHostKey(pk)
 
@@ -126,13 +605,19 @@ func ssh_handleConn(conn net.Conn, config *ssh.ServerConfig, peer *Peer) {
 		log.Println("debug: failed to handshake:", err)
 		return
 	}
-	go ssh.DiscardRequests(reqs)
-	peer.Lock()
-	peer.conns[conn.RemoteAddr().String()] = &ssh_peerConnection{
+	peerConn := &ssh_peerConnection{
 		addr: conn.RemoteAddr().Network() + "://" + conn.RemoteAddr().String(),
 		name: sshConn.User(),
 		conn: sshConn,
+		peer: peer,
 	}
+	go func() {
+		for req := range reqs {
+			ssh_handleGlobalRequest(req, peerConn)
+		}
+	}()
+	peer.Lock()
+	peer.conns[conn.RemoteAddr().String()] = peerConn
 	peer.Unlock()
 	ok, _, err := sshConn.SendRequest("@duplex-greeting", true,
 		ssh.Marshal(&ssh_greetingPayload{peer.GetOption(OptName)}))
@@ -140,29 +625,47 @@ func ssh_handleConn(conn net.Conn, config *ssh.ServerConfig, peer *Peer) {
 		log.Println("debug: failed to greet:", err)
 		return
 	}
-	ssh_acceptChannels(chans, peer)
+	ssh_startKeepalive(peerConn, peer)
+	ssh_acceptChannels(chans, peer, peerConn)
 }
 
 // ssh client
 
 func newPeerConnection_ssh(peer *Peer, network, addr string) (peerConnection, error) {
-	pk, err := loadPrivateKey(peer.GetOption(OptPrivateKey))
+	auth, authCloser, err := clientAuthMethod(peer)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCb, err := hostKeyCallback(peer, network+"://"+addr)
 	if err != nil {
 		return nil, err
 	}
 	config := &ssh.ClientConfig{
-		User: peer.GetOption(OptName),
-		Auth: []ssh.AuthMethod{ssh.PublicKeys(pk)},
+		User:            peer.GetOption(OptName),
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCb,
 	}
 	netConn, err := net.Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
 	conn, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	if authCloser != nil {
+		authCloser.Close()
+	}
 	if err != nil {
 		return nil, err
 	}
-	nameCh := make(chan string)
+	peerConn := &ssh_peerConnection{
+		addr:      network + "://" + addr,
+		conn:      conn,
+		peer:      peer,
+		initiator: true,
+	}
+	// Buffered so the greeting goroutine can't block forever sending to a
+	// nameCh nobody is reading anymore after the handshake-timeout branch
+	// below has already returned.
+	nameCh := make(chan string, 1)
 	go func() {
 		for r := range reqs {
 			switch r.Type {
@@ -175,49 +678,186 @@ func newPeerConnection_ssh(peer *Peer, network, addr string) (peerConnection, er
 				nameCh <- greeting.Name
 				r.Reply(true, nil)
 			default:
-				// This handles keepalive messages and matches
-				// the behaviour of OpenSSH.
-				r.Reply(false, nil)
+				ssh_handleGlobalRequest(r, peerConn)
 			}
 		}
 	}()
-	name := <-nameCh // todo: timeout nameCh
-	go ssh_acceptChannels(chans, peer)
-	return &ssh_peerConnection{
-		addr: network + "://" + addr,
-		name: name,
-		conn: conn,
-	}, nil
+	var name string
+	select {
+	case name = <-nameCh:
+	case <-time.After(handshakeTimeout(peer)):
+		conn.Close()
+		return nil, errors.New("duplex: timed out waiting for peer greeting")
+	}
+	peerConn.name = name
+	go ssh_acceptChannels(chans, peer, peerConn)
+	ssh_startKeepalive(peerConn, peer)
+	return peerConn, nil
 }
 
 // channels
 
+// defaultHandshakeTimeout bounds how long a dial waits for the peer's
+// greeting before giving up, so a silent peer can't pin the goroutine
+// forever.
+const defaultHandshakeTimeout = 30 * time.Second
+
+func handshakeTimeout(peer *Peer) time.Duration {
+	if s := peer.GetOption(OptHandshakeTimeout); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			return d
+		}
+	}
+	return defaultHandshakeTimeout
+}
+
+// defaultKeepaliveMaxMissed is how many unanswered keepalives in a row we
+// tolerate before treating the connection as dead.
+const defaultKeepaliveMaxMissed = 3
+
+// ssh_startKeepalive periodically pings the peer with a "keepalive@duplex"
+// global request when OptKeepaliveInterval is set. After OptKeepaliveMaxMissed
+// consecutive failures (default 3), it disconnects and forgets the
+// connection so reconnect logic, or the caller, can act on a dead link.
+func ssh_startKeepalive(peerConn *ssh_peerConnection, peer *Peer) {
+	intervalStr := peer.GetOption(OptKeepaliveInterval)
+	if intervalStr == "" {
+		return
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		return
+	}
+	maxMissed := defaultKeepaliveMaxMissed
+	if s := peer.GetOption(OptKeepaliveMaxMissed); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			maxMissed = n
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		missed := 0
+		for range ticker.C {
+			ok, _, err := peerConn.conn.SendRequest("keepalive@duplex", true, nil)
+			if err != nil || !ok {
+				missed++
+			} else {
+				missed = 0
+			}
+			if missed >= maxMissed {
+				peerConn.Disconnect()
+				peer.Lock()
+				for addr, c := range peer.conns {
+					if c == peerConn {
+						delete(peer.conns, addr)
+					}
+				}
+				peer.Unlock()
+				return
+			}
+		}
+	}()
+}
+
+const defaultMaxFrameSize = 16 << 20 // 16 MiB
+
+func maxFrameSize(peer *Peer) uint32 {
+	if s := peer.GetOption(OptMaxFrameSize); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			return uint32(n)
+		}
+	}
+	return defaultMaxFrameSize
+}
+
 type ssh_channel struct {
 	ssh.Channel
 	ssh_channelData
+
+	conn         *ssh_peerConnection
+	maxFrameSize uint32
+
+	trailersMu    sync.Mutex
+	trailers      map[string]string
+	trailersReady chan struct{}
+}
+
+// newSSHChannel wraps ch as an *ssh_channel and starts handleRequests, which
+// must run for trailersReady to ever close.
+func newSSHChannel(ch ssh.Channel, reqs <-chan *ssh.Request, data ssh_channelData, conn *ssh_peerConnection, maxFrameSize uint32) *ssh_channel {
+	sc := &ssh_channel{
+		Channel:         ch,
+		ssh_channelData: data,
+		conn:            conn,
+		maxFrameSize:    maxFrameSize,
+		trailersReady:   make(chan struct{}),
+	}
+	go sc.handleRequests(reqs)
+	return sc
 }
 
+func (c *ssh_channel) effectiveMaxFrameSize() uint32 {
+	if c.maxFrameSize > 0 {
+		return c.maxFrameSize
+	}
+	return defaultMaxFrameSize
+}
+
+// ReadFrame reads one length-prefixed frame, using io.ReadFull so a frame
+// straddling an SSH window boundary isn't silently truncated by a short
+// Read. Framed and raw Read/Write must not be mixed on the same channel.
 func (c *ssh_channel) ReadFrame() ([]byte, error) {
-	bytes := make([]byte, 4)
-	_, err := c.Read(bytes)
-	if err != nil {
+	var header [4]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
 		return nil, err
 	}
-	length := binary.BigEndian.Uint32(bytes)
+	length := binary.BigEndian.Uint32(header[:])
+	if length > c.effectiveMaxFrameSize() {
+		return nil, fmt.Errorf("duplex: frame of %d bytes exceeds max frame size of %d", length, c.effectiveMaxFrameSize())
+	}
 	frame := make([]byte, length)
-	_, err = c.Read(frame)
-	// handle errors based on written bytes
-	if err != nil {
+	if _, err := io.ReadFull(c, frame); err != nil {
 		return nil, err
 	}
 	return frame, nil
 }
 
+// ReadFrameInto reads one frame into buf, for callers on a hot path that
+// want to avoid ReadFrame's per-call allocation. It errors if the frame
+// doesn't fit in buf, in which case the body has already been drained so
+// the channel stays in sync for the next framed read. If the frame exceeds
+// the max frame size, the body is left unread (draining an attacker-chosen
+// length is exactly what the limit exists to avoid) and the channel is
+// closed, since it can no longer be used for framed reads.
+func (c *ssh_channel) ReadFrameInto(buf []byte) (int, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > c.effectiveMaxFrameSize() {
+		c.Close()
+		return 0, fmt.Errorf("duplex: frame of %d bytes exceeds max frame size of %d", length, c.effectiveMaxFrameSize())
+	}
+	if int(length) > len(buf) {
+		if _, err := io.CopyN(ioutil.Discard, c, int64(length)); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("duplex: frame of %d bytes does not fit in %d byte buffer", length, len(buf))
+	}
+	if _, err := io.ReadFull(c, buf[:length]); err != nil {
+		return 0, err
+	}
+	return int(length), nil
+}
+
+// WriteFrame writes the header and body as a single Write so that
+// concurrent writers on the same channel can't tear a frame in two.
 func (c *ssh_channel) WriteFrame(frame []byte) error {
-	var buffer []byte
-	n := uint32(len(frame))
-	buffer = append(buffer, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
-	buffer = append(buffer, frame...)
+	buffer := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buffer, uint32(len(frame)))
+	copy(buffer[4:], frame)
 	_, err := c.Write(buffer)
 	return err
 }
@@ -230,12 +870,87 @@ func (c *ssh_channel) Service() string {
 	return c.ssh_channelData.Service
 }
 
-func ssh_acceptChannels(chans <-chan ssh.NewChannel, peer *Peer) {
-	var meta ssh_channelData
+// Open opens a sub-channel attached to c, for structured multi-stream use.
+func (c *ssh_channel) Open(service string, headers []string) (Channel, error) {
+	return c.conn.open(c.ID, service, headers)
+}
+
+// Accept receives the next sub-channel attached to c by the peer.
+func (c *ssh_channel) Accept() (Channel, error) {
+	ch, ok := <-c.conn.attachedChan(c.ID)
+	if !ok {
+		return nil, errors.New("channel closed")
+	}
+	return ch, nil
+}
+
+func (c *ssh_channel) WriteTrailers(trailers map[string]string) error {
+	payload := ssh_trailerPayload{
+		Keys:   make([]string, 0, len(trailers)),
+		Values: make([]string, 0, len(trailers)),
+	}
+	for k, v := range trailers {
+		payload.Keys = append(payload.Keys, k)
+		payload.Values = append(payload.Values, v)
+	}
+	_, err := c.SendRequest("trailers", true, ssh.Marshal(&payload))
+	return err
+}
+
+// Trailers blocks until the peer's "trailers" request has been processed (or
+// the channel's request stream has ended without one), so a call made after
+// Read has returned io.EOF deterministically observes whatever the peer
+// sent, per the Channel interface's contract.
+func (c *ssh_channel) Trailers() map[string]string {
+	<-c.trailersReady
+	c.trailersMu.Lock()
+	defer c.trailersMu.Unlock()
+	return c.trailers
+}
+
+// handleRequests services channel-level requests, recording trailers and
+// replying to (or discarding) everything else, in place of a plain
+// ssh.DiscardRequests so trailers sent just before CloseWrite aren't lost.
+// It closes trailersReady as soon as a "trailers" request has been recorded,
+// or once reqs closes without one ever arriving, so Trailers() has a
+// deterministic point at which to read c.trailers.
+func (c *ssh_channel) handleRequests(reqs <-chan *ssh.Request) {
+	var closeReadyOnce sync.Once
+	closeReady := func() { closeReadyOnce.Do(func() { close(c.trailersReady) }) }
+	defer closeReady()
+	for req := range reqs {
+		switch req.Type {
+		case "trailers":
+			var payload ssh_trailerPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
+				trailers := make(map[string]string, len(payload.Keys))
+				for i, k := range payload.Keys {
+					if i < len(payload.Values) {
+						trailers[k] = payload.Values[i]
+					}
+				}
+				c.trailersMu.Lock()
+				c.trailers = trailers
+				c.trailersMu.Unlock()
+			}
+			closeReady()
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func ssh_acceptChannels(chans <-chan ssh.NewChannel, peer *Peer, conn *ssh_peerConnection) {
 	for newCh := range chans {
 		switch newCh.ChannelType() {
 		case "@duplex":
 			go func() {
+				var meta ssh_channelData
 				err := ssh.Unmarshal(newCh.ExtraData(), &meta)
 				if err != nil {
 					newCh.Reject(ssh.UnknownChannelType, "failed to parse channel data")
@@ -245,14 +960,83 @@ func ssh_acceptChannels(chans <-chan ssh.NewChannel, peer *Peer) {
 					newCh.Reject(ssh.UnknownChannelType, "empty service")
 					return
 				}
+				ch, reqs, err := newCh.Accept()
+				if err != nil {
+					log.Println("debug: accept error:", err)
+					return
+				}
+				sc := newSSHChannel(ch, reqs, meta, conn, maxFrameSize(peer))
+				if meta.FlagAttached {
+					conn.attachedChan(meta.Attach) <- sc
+					return
+				}
+				peer.incomingCh <- sc
+			}()
+		case "@duplex-forward":
+			go func() {
+				var payload ssh_forwardPayload
+				if err := ssh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+					newCh.Reject(ssh.UnknownChannelType, "failed to parse forward data")
+					return
+				}
+				conn.mu.Lock()
+				accept, listening := conn.forwardListeners[forwardKey(payload.Network, payload.Addr)]
+				conn.mu.Unlock()
+
+				// A listening forward was set up by us (via ListenRemote),
+				// so it's already authorized; a direct dial is the peer
+				// asking us to reach out on its behalf and needs its own
+				// authorization check before we touch the network.
+				if !listening {
+					if err := forwardAllowed(peer, payload.Network, payload.Addr, false); err != nil {
+						newCh.Reject(ssh.Prohibited, "forwarding not permitted")
+						return
+					}
+				}
+
 				ch, reqs, err := newCh.Accept()
 				if err != nil {
 					log.Println("debug: accept error:", err)
 					return
 				}
 				go ssh.DiscardRequests(reqs)
-				peer.incomingCh <- &ssh_channel{ch, meta}
+
+				if listening {
+					// This is a connection accepted by the peer on a
+					// listener we started with ListenRemote. accept.closed
+					// guards against the listener having been closed (or the
+					// connection torn down) concurrently with this delivery.
+					select {
+					case accept.conns <- &ssh_forwardConn{Channel: ch, laddr: addrString{payload.Network, payload.Addr}}:
+					case <-accept.closed:
+						ch.Close()
+					}
+					return
+				}
+				// Otherwise this is a direct DialRemote request: dial
+				// locally and bridge.
+				defer ch.Close()
+				dialConn, err := net.Dial(payload.Network, payload.Addr)
+				if err != nil {
+					return
+				}
+				defer dialConn.Close()
+				bridge(ch, dialConn)
 			}()
 		}
 	}
+	// chans has closed, meaning this connection is gone: close out any
+	// local listeners we opened on the peer's behalf via "forward-listen@
+	// duplex", or they'd otherwise stay bound forever, and close the accept
+	// queues of our own ListenRemote listeners so their Accept calls return.
+	conn.mu.Lock()
+	for key, listener := range conn.remoteListeners {
+		listener.Close()
+		delete(conn.remoteListeners, key)
+	}
+	for key, accept := range conn.forwardListeners {
+		accept.close()
+		delete(conn.forwardListeners, key)
+	}
+	conn.mu.Unlock()
 }